@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+//AttachmentPolicy caps and filters attachments before they are uploaded to
+//Mattermost, and optionally scans them for malware
+type AttachmentPolicy struct {
+	MaxFileSize       int64
+	MaxTotalSize      int64
+	AllowMIMETypes    []string
+	DenyMIMETypes     []string
+	StripInlineImages bool
+	QuarantineFolder  string
+
+	Scanner     string // "" or "clamav"
+	ScannerAddr string
+}
+
+//rejectedAttachment records why an attachment did not get posted
+type rejectedAttachment struct {
+	Filename string
+	Size     int64
+	Reason   string
+}
+
+//quarantiner is implemented by stores that can move a message out of the
+//user's mailbox once an attachment comes back infected
+type quarantiner interface {
+	Quarantine(uid uint32, folder string) error
+}
+
+//apply enforces p against attachments, returning the ones allowed through,
+//the ones rejected (with a reason) and whether any of them came back
+//infected, in which case the whole message should be quarantined instead of
+//posted
+func (p AttachmentPolicy) apply(scanner Scanner, attachments []attachment) (allowed []attachment, rejected []rejectedAttachment, infected bool) {
+	var totalSize int64
+
+	for _, a := range attachments {
+		size := int64(len(a.Content))
+
+		if reason, blocked := p.reject(a, size); blocked {
+			rejected = append(rejected, rejectedAttachment{Filename: a.Filename, Size: size, Reason: reason})
+			continue
+		}
+
+		if totalSize+size > p.MaxTotalSize && p.MaxTotalSize > 0 {
+			rejected = append(rejected, rejectedAttachment{Filename: a.Filename, Size: size, Reason: "total attachment size limit exceeded"})
+			continue
+		}
+
+		if verdict, err := scanner.Scan(a.Filename, a.Content); verdict == ScanInfected {
+			rejected = append(rejected, rejectedAttachment{Filename: a.Filename, Size: size, Reason: "infected"})
+			infected = true
+			continue
+		} else if verdict == ScanError {
+			rejected = append(rejected, rejectedAttachment{Filename: a.Filename, Size: size, Reason: fmt.Sprintf("scan error: %v", err)})
+			continue
+		}
+
+		totalSize += size
+		allowed = append(allowed, a)
+	}
+
+	return allowed, rejected, infected
+}
+
+//reject checks a single attachment's size and MIME type against the policy
+func (p AttachmentPolicy) reject(a attachment, size int64) (reason string, blocked bool) {
+	if p.MaxFileSize > 0 && size > p.MaxFileSize {
+		return fmt.Sprintf("%d bytes exceeds the %d byte limit", size, p.MaxFileSize), true
+	}
+
+	contentType := http.DetectContentType(a.Content)
+
+	for _, pattern := range p.DenyMIMETypes {
+		if mimeGlobMatch(pattern, contentType) {
+			return fmt.Sprintf("type %s is denied", contentType), true
+		}
+	}
+
+	if len(p.AllowMIMETypes) > 0 {
+		allowed := false
+		for _, pattern := range p.AllowMIMETypes {
+			if mimeGlobMatch(pattern, contentType) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Sprintf("type %s is not in the allow list", contentType), true
+		}
+	}
+
+	return "", false
+}
+
+//mimeGlobMatch matches a MIME type against a glob pattern such as "image/*"
+func mimeGlobMatch(pattern, mimeType string) bool {
+	ok, err := filepath.Match(pattern, mimeType)
+	return err == nil && ok
+}
+
+//formatRejected renders rejected attachments as a bulleted "filename (size, reason)" list
+func formatRejected(rejected []rejectedAttachment) string {
+	if len(rejected) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	for _, r := range rejected {
+		fmt.Fprintf(&b, "- %s (%d bytes, %s)\n", r.Filename, r.Size, r.Reason)
+	}
+	return b.String()
+}
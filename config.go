@@ -0,0 +1,42 @@
+package main
+
+//config holds the settings for a single MatterMail instance: one IMAP/SMTP
+//mail account bridged into one Mattermost server
+type config struct {
+	Name string
+
+	//Mattermost
+	Server         string
+	Team           string
+	MattermostUser string
+	MattermostPass string
+	Channel        string
+	MailTemplate   string
+
+	//Mail account
+	Email      string
+	EmailPass  string
+	ImapServer string
+
+	//SMTP send + reply-from-Mattermost bridge
+	SmtpServer   string
+	SmtpUser     string
+	SmtpPass     string
+	WebhookToken string
+	ListenAddr   string
+
+	//IMAP TLS/auth
+	TLSSkipVerify bool
+	OAuth2Token   string
+
+	//Rules routes mail to channels; when empty, Channel/MailTemplate above
+	//are used as a single implicit INBOX rule
+	Rules []Rule
+
+	//Store selects the backend: "imap" (default), "maildir" or "spool"
+	Store       string
+	MaildirPath string
+	SpoolPath   string
+
+	AttachmentPolicy AttachmentPolicy
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"github.com/emersion/go-message/charset"
+	"mime"
+)
+
+//partHeader is satisfied by *mail.AttachmentHeader, the only go-message part
+//header type that has a Filename() method
+type partHeader interface {
+	Get(string) string
+	Filename() (string, error)
+}
+
+//partFilename returns a message part's filename, preferring go-message's own
+//Filename() and falling back to rawPartFilename for the cases it doesn't
+//cover (e.g. RFC 2231 continuations it fails to join)
+func partFilename(h partHeader) string {
+	if name, err := h.Filename(); err == nil && len(name) > 0 {
+		return name
+	}
+	return rawPartFilename(h)
+}
+
+//rawPartFilename extracts a filename directly from a part's raw
+//Content-Disposition/Content-Type header value. Use this for
+//*mail.InlineHeader, which go-message deliberately gives no Filename()
+//method (see its PartHeader interface in reader.go).
+func rawPartFilename(h interface{ Get(string) string }) string {
+	if name := decodeFilename(h.Get("Content-Disposition")); len(name) > 0 {
+		return name
+	}
+	return decodeFilename(h.Get("Content-Type"))
+}
+
+//headerDecoder decodes RFC 2047 encoded-words, resolving the charset of each
+//encoded-word through go-message/charset instead of the small set mime's
+//default reader understands
+var headerDecoder = &mime.WordDecoder{CharsetReader: charset.Reader}
+
+//decodeHeader decodes RFC 2047 encoded-words in a header value (Subject,
+//From, To, Cc, ...), returning s unchanged if it isn't encoded or if
+//decoding fails
+func decodeHeader(s string) string {
+	decoded, err := headerDecoder.DecodeHeader(s)
+	if err != nil {
+		return s
+	}
+	return decoded
+}
+
+//decodeFilename extracts the filename parameter from a raw Content-Type or
+//Content-Disposition header value, transparently joining RFC 2231
+//continuation-encoded filenames (filename*0*, filename*1*, ...)
+func decodeFilename(header string) string {
+	if len(header) == 0 {
+		return ""
+	}
+
+	_, params, err := mime.ParseMediaType(header)
+	if err != nil {
+		return ""
+	}
+
+	return params["filename"]
+}
@@ -0,0 +1,76 @@
+package main
+
+import "testing"
+
+func TestDecodeHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded string
+		want    string
+	}{
+		{"plain ascii", "Hello there", "Hello there"},
+		{"utf-8 base64", "=?utf-8?b?Y2Fmw6k=?=", "café"},
+		{"utf-8 quoted-printable", "=?utf-8?q?caf=C3=A9?=", "café"},
+		{"iso-2022-jp base64", "=?iso-2022-jp?b?GyRCRnxLXDhsGyhC?=", "日本語"},
+		{"gb2312 base64", "=?gb2312?b?1tDOxLLiytQ=?=", "中文测试"},
+		{"koi8-r base64", "=?koi8-r?b?0NLJ18XU?=", "привет"},
+		{"folded encoded-words", "=?utf-8?b?Y2Fmw6k=?=\r\n =?koi8-r?b?0NLJ18XU?=", "caféпривет"},
+		{"mixed charsets in one header", "=?utf-8?b?Y2Fmw6k=?= plain =?gb2312?b?1tDOxLLiytQ=?=", "café plain 中文测试"},
+		{"unknown charset falls back to original", "=?bogus-charset?b?Y2Fmw6k=?=", "=?bogus-charset?b?Y2Fmw6k=?="},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := decodeHeader(tt.encoded); got != tt.want {
+				t.Errorf("decodeHeader(%q) = %q, want %q", tt.encoded, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeFilename(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{
+			"simple filename",
+			`attachment; filename="report.pdf"`,
+			"report.pdf",
+		},
+		{
+			"rfc 2231 charset filename",
+			`attachment; filename*=UTF-8''caf%C3%A9.txt`,
+			"café.txt",
+		},
+		{
+			"rfc 2231 continuation",
+			`attachment; filename*0="this-is-a-very-"; filename*1="long-file-name.txt"`,
+			"this-is-a-very-long-file-name.txt",
+		},
+		{
+			"rfc 2231 continuation with charset on first segment",
+			`attachment; filename*0*=UTF-8''caf%C3%A9-; filename*1="report.pdf"`,
+			"café-report.pdf",
+		},
+		{
+			"empty header",
+			"",
+			"",
+		},
+		{
+			"malformed header",
+			"not a content-disposition",
+			"",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := decodeFilename(tt.header); got != tt.want {
+				t.Errorf("decodeFilename(%q) = %q, want %q", tt.header, got, tt.want)
+			}
+		})
+	}
+}
@@ -4,179 +4,76 @@ import (
 	"bytes"
 	"encoding/base64"
 	"fmt"
-	"github.com/jhillyerd/go.enmime"
+	gomail "github.com/emersion/go-message/mail"
 	"github.com/mattermost/platform/model"
-	"github.com/mxk/go-imap/imap"
-	"github.com/paulrosania/go-charset/charset"
-	_ "github.com/paulrosania/go-charset/data"
+	"io"
 	"io/ioutil"
 	"log"
 	"mime/multipart"
-	"mime/quotedprintable"
-	"net/mail"
 	"os"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 )
 
 type MatterMail struct {
-	cfg        *config
-	imapClient *imap.Client
-	logI       *log.Logger
-	logE       *log.Logger
+	cfg     *config
+	store   Store
+	scanner Scanner
+	logI    *log.Logger
+	logE    *log.Logger
+
+	threadsMutex sync.Mutex
+	threads      []threadInfo
 }
 
-func (m *MatterMail) tryTime(message string, fn func() error) {
-	if err := fn(); err != nil {
-		m.logI.Println(message, err, "\n", "Try again in 30s")
-		time.Sleep(30 * time.Second)
-		fn()
-	}
-}
-
-func (m *MatterMail) LogoutImapClient() {
-	if m.imapClient != nil {
-		m.imapClient.Logout(time.Second * 5)
-	}
-}
-
-func (m *MatterMail) CheckImapConnection() error {
-	if m.imapClient != nil && (m.imapClient.State() == imap.Auth || m.imapClient.State() == imap.Selected) {
-		return nil
-	}
-
-	var err error
-	//Start connection with server
-	m.imapClient, err = imap.Dial(m.cfg.ImapServer)
-
-	if err != nil {
-		m.logE.Println("Unable to connect:", err)
-		return err
-	}
-
-	m.logI.Printf("Connected with %q\n", m.cfg.ImapServer)
-
-	_, err = m.imapClient.Login(m.cfg.Email, m.cfg.EmailPass)
-	if err != nil {
-		m.logE.Println("Unable to login:", m.cfg.Email)
-		return err
-	}
-
-	return nil
-}
-
-//Check if exist a new mail and post it
-func (m *MatterMail) CheckNewMails() error {
-
-	if err := m.CheckImapConnection(); err != nil {
-		return err
-	}
-
-	var (
-		cmd *imap.Command
-		rsp *imap.Response
-	)
-
-	// Open a mailbox (synchronous command - no need for imap.Wait)
-	m.imapClient.Select("INBOX", false)
-
-	var specs []imap.Field
-	specs = append(specs, "UNSEEN")
-	seq := &imap.SeqSet{}
+const maxBackoff = 5 * time.Minute
 
-	// get headers and UID for UnSeen message in src inbox...
-	cmd, err := imap.Wait(m.imapClient.UIDSearch(specs...))
-	if err != nil {
-		m.logE.Println("UIDSearch:")
-		return err
-	}
+//tryTime calls fn, retrying with exponential backoff until it succeeds
+func (m *MatterMail) tryTime(message string, fn func() error) {
+	backoff := 2 * time.Second
 
-	for _, rsp := range cmd.Data {
-		for _, uid := range rsp.SearchResults() {
-			seq.AddNum(uid)
+	for {
+		err := fn()
+		if err == nil {
+			return
 		}
-	}
 
-	// no new messages
-	if seq.Empty() {
-		return nil
-	}
+		m.logI.Println(message, err, "\n", "Retrying in", backoff)
+		time.Sleep(backoff)
 
-	cmd, _ = m.imapClient.Fetch(seq, "FLAGS", "INTERNALDATE", "UID", "RFC822.HEADER", "BODY[]")
-
-	for cmd.InProgress() {
-		// Wait for the next response (no timeout)
-		m.imapClient.Recv(-1)
-
-		// Process command data
-		for _, rsp = range cmd.Data {
-			msgFields := rsp.MessageInfo().Attrs
-			header := imap.AsBytes(msgFields["BODY[]"])
-			if msg, _ := mail.ReadMessage(bytes.NewReader(header)); msg != nil {
-				if err := m.PostMail(msg); err != nil {
-					return err
-				}
-			}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
 		}
-		cmd.Data = nil
 	}
+}
 
-	// Check command completion status
-	if rsp, err := cmd.Result(imap.OK); err != nil {
-		if err == imap.ErrAborted {
-			m.logE.Println("Fetch command aborted")
-			return err
-		} else {
-			m.logE.Println("Fetch error:", rsp.Info)
-			return err
-		}
-	}
-
-	cmd.Data = nil
-
-	//Mark all messages seen
-	_, err = imap.Wait(m.imapClient.UIDStore(seq, "+FLAGS.SILENT", `\Seen`))
-	if err != nil {
-		m.logE.Printf("Error UIDStore \\Seen")
-		return err
-	}
-	return nil
+//CheckNewMails looks for unread mail matching the configured rules and posts
+//each match to Mattermost
+func (m *MatterMail) CheckNewMails() error {
+	return m.store.CheckNewMails()
 }
 
-//Change to state idle in imap server
+//IdleMailBox blocks until new mail might be available
 func (m *MatterMail) IdleMailBox() error {
+	return m.store.IdleMailBox()
+}
 
-	if err := m.CheckImapConnection(); err != nil {
-		return err
-	}
-
-	// Open a mailbox (synchronous command - no need for imap.Wait)
-	m.imapClient.Select("INBOX", false)
-
-	_, err := m.imapClient.Idle()
-	if err != nil {
-		return err
-	}
-
-	defer m.imapClient.IdleTerm()
-
-	for {
-		err := m.imapClient.Recv(time.Second)
-		if err == nil {
-			break
-		}
-	}
-	return nil
+//attachment is a file to upload alongside a Mattermost post: an inline
+//email.html/email.txt rendering or a real email attachment
+type attachment struct {
+	Filename string
+	Content  []byte
 }
 
-func addPart(client *model.Client, filename string, content *[]byte, writer *multipart.Writer) error {
+func addPart(filename string, content []byte, writer *multipart.Writer) error {
 	part, err := writer.CreateFormFile("files", filename)
 	if err != nil {
 		return err
 	}
 
-	_, err = part.Write(*content)
+	_, err = part.Write(content)
 	if err != nil {
 		return err
 	}
@@ -199,13 +96,14 @@ func (m *MatterMail) postMessage(client *model.Client, channel_id string, messag
 	return nil
 }
 
-//Post files and message in Mattermost server
-func (m *MatterMail) PostFile(message string, emailname string, emailbody *string, attach *[]enmime.MIMEPart) error {
+//Post files and message in Mattermost server, returning the id of the
+//channel the message was posted to
+func (m *MatterMail) PostFile(channel string, message string, emailname string, emailbody *string, attach []attachment) (string, error) {
 
 	client := model.NewClient(m.cfg.Server)
 
 	if _, err := client.LoginByEmail(m.cfg.Team, m.cfg.MattermostUser, m.cfg.MattermostPass); err != nil {
-		return err
+		return "", err
 	}
 
 	m.logI.Println("Post new message")
@@ -219,7 +117,7 @@ func (m *MatterMail) PostFile(message string, emailname string, emailbody *strin
 
 	nameMatch := false
 	for _, c := range rget.Channels {
-		if c.Name == m.cfg.Channel {
+		if c.Name == channel {
 			channel_id = c.Id
 			nameMatch = true
 			break
@@ -227,52 +125,49 @@ func (m *MatterMail) PostFile(message string, emailname string, emailbody *strin
 	}
 
 	if !nameMatch {
-		return fmt.Errorf("Did not find channel with name %v", m.cfg.Channel)
+		return "", fmt.Errorf("Did not find channel with name %v", channel)
 	}
 
-	if len(*attach) == 0 && len(emailname) == 0 {
-		return m.postMessage(client, channel_id, message, nil)
+	if len(attach) == 0 && len(emailname) == 0 {
+		return channel_id, m.postMessage(client, channel_id, message, nil)
 	}
 
 	buf := &bytes.Buffer{}
 	writer := multipart.NewWriter(buf)
 
-	var email []byte
 	if len(emailname) > 0 {
-		email = []byte(*emailbody)
-		if err := addPart(client, emailname, &email, writer); err != nil {
-			return err
+		if err := addPart(emailname, []byte(*emailbody), writer); err != nil {
+			return "", err
 		}
 	}
 
-	for _, a := range *attach {
-		email = a.Content()
-		if err := addPart(client, a.FileName(), &email, writer); err != nil {
-			return err
+	for _, a := range attach {
+		if err := addPart(a.Filename, a.Content, writer); err != nil {
+			return "", err
 		}
 	}
 
 	field, err := writer.CreateFormField("channel_id")
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	_, err = field.Write([]byte(channel_id))
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	err = writer.Close()
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	resp, err := client.UploadFile("/files/upload", buf.Bytes(), writer.FormDataContentType())
 	if resp == nil {
-		return err
+		return "", err
 	}
 
-	return m.postMessage(client, channel_id, message, &resp.Data.(*model.FileUploadResponse).Filenames)
+	return channel_id, m.postMessage(client, channel_id, message, &resp.Data.(*model.FileUploadResponse).Filenames)
 }
 
 //Read number of lines of string
@@ -285,112 +180,140 @@ func readLines(s string, nmax int) string {
 	return strings.Join(lines[:], "\n")
 }
 
-//Replace cid:**** by embedded base64 image
-func replaceCID(html *string, part *enmime.MIMEPart) string {
-	cid := strings.Replace((*part).Header().Get("Content-ID"), "<", "", -1)
-	cid = strings.Replace(cid, ">", "", -1)
+//inlineImage is a part referenced from the HTML body via cid:
+type inlineImage struct {
+	contentType string
+	content     []byte
+}
 
-	if len(cid) == 0 {
-		return *html
+//Post an email in Mattermost, formatted with template and posted to channel.
+//r must contain the full raw RFC 5322 message (headers and body)
+func (m *MatterMail) PostMail(uid uint32, r io.Reader, channel, template string) error {
+	mr, err := gomail.CreateReader(r)
+	if err != nil {
+		m.logE.Println("Error parsing mail:", err)
+		return err
 	}
 
-	b64 := "data:" + (*part).ContentType() + ";base64," + base64.StdEncoding.EncodeToString((*part).Content())
+	var htmlBody, textBody string
+	var attachments []attachment
+	cidImages := make(map[string]inlineImage)
 
-	return strings.Replace(*html, "cid:"+cid, b64, -1)
-}
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			m.logE.Println("Error reading mail part:", err)
+			break
+		}
 
-//Decode non ASCII header string RFC 1342
-//encoded-word = "=?" charset "?" encoding "?" encoded-text "?="
-func NonASCII(encoded string) string {
-
-	regex_rfc1342, _ := regexp.Compile(`=\?[^\?]*\?.\?[^\?]*\?=`)
-
-	result := regex_rfc1342.ReplaceAllStringFunc(encoded, func(encoded string) string {
-		//0 utf 1 B/Q 2 code
-		v := strings.Split(encoded, "?")[1:4]
-		var decoded string
-		switch strings.ToLower(v[1]) {
-		case "b": //Base64
-			data, err := base64.StdEncoding.DecodeString(v[2])
-			if err != nil {
-				log.Println("Error decode Base64", err)
-				return encoded
-			}
+		content, err := ioutil.ReadAll(p.Body)
+		if err != nil {
+			m.logE.Println("Error reading mail part:", err)
+			continue
+		}
 
-			decoded = string(data)
+		switch h := p.Header.(type) {
+		case *gomail.InlineHeader:
+			contentType, _, _ := h.ContentType()
+			cid := strings.Trim(h.Get("Content-Id"), "<>")
+
+			switch {
+			case strings.HasPrefix(contentType, "text/html"):
+				htmlBody = string(content)
+			case strings.HasPrefix(contentType, "text/plain"):
+				textBody = string(content)
+			case len(cid) > 0:
+				cidImages[cid] = inlineImage{contentType: contentType, content: content}
+			default:
+				if filename := rawPartFilename(h); len(filename) > 0 {
+					attachments = append(attachments, attachment{Filename: filename, Content: content})
+				}
+			}
 
-		case "q": //Quoted-Printable
-			data, err := ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(v[2])))
-			if err != nil {
-				log.Println("Error decode Quoted-Printable", err)
-				return encoded
+		case *gomail.AttachmentHeader:
+			if cid := strings.Trim(h.Get("Content-Id"), "<>"); len(cid) > 0 {
+				contentType, _, _ := h.ContentType()
+				cidImages[cid] = inlineImage{contentType: contentType, content: content}
+				continue
 			}
-			decoded = string(data)
 
-		default:
-			log.Println("Unknow encoding " + v[1])
-			return encoded
+			attachments = append(attachments, attachment{Filename: partFilename(h), Content: content})
 		}
+	}
 
-		//Decode charset
-		r, err := charset.NewReader(strings.ToLower(v[0]), strings.NewReader(decoded))
-		if err != nil {
-			log.Println("Error decode charset", err)
-			return encoded
+	var emailname, emailbody string
+	if len(htmlBody) > 0 {
+		emailname = "email.html"
+		emailbody = htmlBody
+		if !m.cfg.AttachmentPolicy.StripInlineImages {
+			for cid, img := range cidImages {
+				b64 := "data:" + img.contentType + ";base64," + base64.StdEncoding.EncodeToString(img.content)
+				emailbody = strings.Replace(emailbody, "cid:"+cid, b64, -1)
+			}
 		}
+	} else if len(textBody) > 0 {
+		emailname = "email.txt"
+		emailbody = textBody
+	}
 
-		result, _ := ioutil.ReadAll(r)
+	// read only some lines of text
+	partmessage := readLines(textBody, 5)
 
-		return string(result)
-	})
+	if partmessage != textBody && len(partmessage) > 0 {
+		partmessage += " ..."
+	}
 
-	return result
-}
+	from := decodeHeader(mr.Header.Get("From"))
+	subject := decodeHeader(mr.Header.Get("Subject"))
+	message := fmt.Sprintf(template, from, subject, partmessage)
 
-//Post an email in Mattermost
-func (m *MatterMail) PostMail(msg *mail.Message) error {
-	mime, _ := enmime.ParseMIMEBody(msg) // Parse message body with enmime
+	allowed, rejected, infected := m.cfg.AttachmentPolicy.apply(m.scanner, attachments)
 
-	var emailname, emailbody string
-	if len(mime.Html) > 0 {
-		emailname = "email.html"
-		emailbody = mime.Html
-		for _, p := range mime.Inlines {
-			emailbody = replaceCID(&emailbody, &p)
-		}
-
-		for _, p := range mime.OtherParts {
-			emailbody = replaceCID(&emailbody, &p)
+	if infected {
+		if q, ok := m.store.(quarantiner); ok {
+			if err := q.Quarantine(uid, m.cfg.AttachmentPolicy.QuarantineFolder); err != nil {
+				m.logE.Println("Error quarantining message:", err)
+			}
+		} else {
+			m.logE.Println("Infected message can't be quarantined: store doesn't support it")
 		}
 
-	} else if len(mime.Text) > 0 {
-		emailname = "email.txt"
-		emailbody = mime.Text
+		message = fmt.Sprintf("%s\n\n*This message contained an infected attachment and was quarantined:*\n%s", message, formatRejected(rejected))
+		_, err := m.PostFile(channel, message, "", new(string), nil)
+		return err
 	}
 
-	// read only some lines of text
-	partmessage := readLines(mime.Text, 5)
+	if len(rejected) > 0 {
+		message = fmt.Sprintf("%s\n\n*Some attachments were not posted:*\n%s", message, formatRejected(rejected))
+	}
 
-	if partmessage != mime.Text && len(partmessage) > 0 {
-		partmessage += " ..."
+	channelID, err := m.PostFile(channel, message, emailname, &emailbody, allowed)
+	if err != nil {
+		return err
 	}
 
-	message := fmt.Sprintf(m.cfg.MailTemplate, NonASCII(msg.Header.Get("From")), mime.GetHeader("Subject"), partmessage)
+	m.rememberThread(uid, mr.Header.Get("Message-Id"), channelID, from, subject)
 
-	return m.PostFile(message, emailname, &emailbody, &mime.Attachments)
+	return nil
 }
 
 func InitMatterMail(cfg *config) {
-	//imap.DefaultLogger = log.New(os.Stdout, "", 0)
-	//imap.DefaultLogMask = imap.LogConn | imap.LogRaw
-
 	m := &MatterMail{
-		cfg:  cfg,
-		logI: log.New(os.Stdout, "INFO  "+cfg.Name+"\t", log.Ltime),
-		logE: log.New(os.Stderr, "ERROR "+cfg.Name+"\t", log.Ltime),
+		cfg:     cfg,
+		scanner: newScanner(cfg),
+		logI:    log.New(os.Stdout, "INFO  "+cfg.Name+"\t", log.Ltime),
+		logE:    log.New(os.Stderr, "ERROR "+cfg.Name+"\t", log.Ltime),
 	}
 
-	defer m.LogoutImapClient()
+	m.store = newStore(m)
+	defer m.store.Close()
+
+	if len(cfg.ListenAddr) > 0 {
+		go m.startWebhookServer()
+	}
 
 	m.logI.Println("Checking new emails")
 	m.tryTime("Error on check new email:", m.CheckNewMails)
@@ -0,0 +1,39 @@
+package main
+
+//Rule binds a mailbox (or a LIST pattern matching several mailboxes) to a
+//Mattermost channel, with a search narrowing which messages qualify and a
+//MessageTemplate overriding cfg.MailTemplate for that channel
+type Rule struct {
+	Mailbox         string
+	SearchCriteria  SearchCriteria
+	Channel         string
+	MessageTemplate string
+}
+
+//SearchCriteria mirrors the subset of RFC 3501 SEARCH keys useful for
+//routing mail: header matches, flag checks and a SENTSINCE date
+type SearchCriteria struct {
+	From      string
+	To        string
+	Subject   string
+	HasFlag   []string
+	NotFlag   []string
+	SentSince string // "2006-01-02"
+}
+
+//rules returns cfg.Rules, or a single rule mirroring the legacy
+//single-mailbox/single-channel behaviour when none are configured
+func (m *MatterMail) rules() []Rule {
+	if len(m.cfg.Rules) == 0 {
+		return []Rule{{Mailbox: "INBOX", Channel: m.cfg.Channel, MessageTemplate: m.cfg.MailTemplate}}
+	}
+
+	rules := make([]Rule, len(m.cfg.Rules))
+	for i, rule := range m.cfg.Rules {
+		if len(rule.MessageTemplate) == 0 {
+			rule.MessageTemplate = m.cfg.MailTemplate
+		}
+		rules[i] = rule
+	}
+	return rules
+}
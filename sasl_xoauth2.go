@@ -0,0 +1,30 @@
+package main
+
+import "github.com/emersion/go-sasl"
+
+//xoauth2Client implements the XOAUTH2 SASL mechanism used by Gmail/O365 to
+//authenticate with an OAuth2 access token instead of a password. go-sasl
+//only ships OAUTHBEARER (RFC 7628), a different mechanism, so this is hand
+//rolled per Google's "SMTP/IMAP XOAUTH2" spec.
+type xoauth2Client struct {
+	username string
+	token    string
+}
+
+//newXoauth2Client returns a sasl.Client authenticating username with token
+//via XOAUTH2
+func newXoauth2Client(username, token string) sasl.Client {
+	return &xoauth2Client{username: username, token: token}
+}
+
+func (c *xoauth2Client) Start() (mech string, ir []byte, err error) {
+	ir = []byte("user=" + c.username + "\x01auth=Bearer " + c.token + "\x01\x01")
+	return "XOAUTH2", ir, nil
+}
+
+//Next responds to the server's error continuation (a base64-encoded JSON
+//error) with an empty response, as required to make the server return the
+//final failure status instead of waiting forever
+func (c *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	return []byte{}, nil
+}
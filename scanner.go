@@ -0,0 +1,33 @@
+package main
+
+//ScanVerdict is the result of scanning an attachment for malicious content
+type ScanVerdict int
+
+const (
+	ScanClean ScanVerdict = iota
+	ScanInfected
+	ScanError
+)
+
+//Scanner inspects attachment content before it is posted to Mattermost
+type Scanner interface {
+	Scan(filename string, content []byte) (ScanVerdict, error)
+}
+
+//noopScanner is used when no scanner is configured: everything is clean
+type noopScanner struct{}
+
+func (noopScanner) Scan(filename string, content []byte) (ScanVerdict, error) {
+	return ScanClean, nil
+}
+
+//newScanner builds the Scanner configured in cfg.AttachmentPolicy, defaulting
+//to noopScanner when none is set
+func newScanner(cfg *config) Scanner {
+	switch cfg.AttachmentPolicy.Scanner {
+	case "clamav":
+		return &clamdScanner{addr: cfg.AttachmentPolicy.ScannerAddr}
+	default:
+		return noopScanner{}
+	}
+}
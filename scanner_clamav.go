@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+//clamdScanner talks the clamd INSTREAM protocol over a plain TCP connection
+//(clamd's TCPSocket, not the Unix socket)
+type clamdScanner struct {
+	addr string
+}
+
+const clamdChunkSize = 4096
+const clamdTimeout = 10 * time.Second
+
+func (s *clamdScanner) Scan(filename string, content []byte) (ScanVerdict, error) {
+	conn, err := net.DialTimeout("tcp", s.addr, clamdTimeout)
+	if err != nil {
+		return ScanError, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(clamdTimeout))
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return ScanError, err
+	}
+
+	for offset := 0; offset < len(content); offset += clamdChunkSize {
+		end := offset + clamdChunkSize
+		if end > len(content) {
+			end = len(content)
+		}
+
+		chunk := content[offset:end]
+
+		size := make([]byte, 4)
+		binary.BigEndian.PutUint32(size, uint32(len(chunk)))
+
+		if _, err := conn.Write(size); err != nil {
+			return ScanError, err
+		}
+		if _, err := conn.Write(chunk); err != nil {
+			return ScanError, err
+		}
+	}
+
+	// zero-length chunk terminates the stream
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return ScanError, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		return ScanError, err
+	}
+
+	reply = strings.TrimRight(reply, "\x00")
+
+	switch {
+	case strings.HasSuffix(reply, "OK"):
+		return ScanClean, nil
+	case strings.Contains(reply, "FOUND"):
+		return ScanInfected, fmt.Errorf("%s: %s", filename, strings.TrimSpace(reply))
+	default:
+		return ScanError, fmt.Errorf("clamd: %s", strings.TrimSpace(reply))
+	}
+}
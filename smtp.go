@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+//Number of posted mails to keep in memory so a Mattermost post can be
+//attached to the mail it came from
+const maxThreadHistory = 50
+
+//threadInfo links a Mattermost channel with the last mail posted there so a
+//reply typed in that channel can be delivered as a threaded email
+type threadInfo struct {
+	UID       uint32
+	MessageID string
+	ChannelID string
+	From      string
+	Subject   string
+}
+
+//rememberThread stores the last mail posted to a channel, trimming the
+//history to maxThreadHistory entries
+func (m *MatterMail) rememberThread(uid uint32, messageID, channelID, from, subject string) {
+	if len(messageID) == 0 || len(channelID) == 0 {
+		return
+	}
+
+	m.threadsMutex.Lock()
+	defer m.threadsMutex.Unlock()
+
+	m.threads = append(m.threads, threadInfo{UID: uid, MessageID: messageID, ChannelID: channelID, From: from, Subject: subject})
+	if len(m.threads) > maxThreadHistory {
+		m.threads = m.threads[len(m.threads)-maxThreadHistory:]
+	}
+}
+
+//lastThread returns the most recent mail posted to channelID, newest first
+func (m *MatterMail) lastThread(channelID string) (threadInfo, bool) {
+	m.threadsMutex.Lock()
+	defer m.threadsMutex.Unlock()
+
+	for i := len(m.threads) - 1; i >= 0; i-- {
+		if m.threads[i].ChannelID == channelID {
+			return m.threads[i], true
+		}
+	}
+	return threadInfo{}, false
+}
+
+//dialSMTP connects to cfg.SmtpServer, using implicit TLS when the address
+//ends in the standard SMTPS port and STARTTLS otherwise when available
+func (m *MatterMail) dialSMTP() (*smtp.Client, error) {
+	if strings.HasSuffix(m.cfg.SmtpServer, ":465") {
+		host, _, _ := strings.Cut(m.cfg.SmtpServer, ":")
+		conn, err := tls.Dial("tcp", m.cfg.SmtpServer, &tls.Config{ServerName: host})
+		if err != nil {
+			return nil, err
+		}
+		return smtp.NewClient(conn, host)
+	}
+
+	host, _, _ := strings.Cut(m.cfg.SmtpServer, ":")
+	client, err := smtp.Dial(m.cfg.SmtpServer)
+	if err != nil {
+		return nil, err
+	}
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+
+	return client, nil
+}
+
+//SendMail logs in to cfg.SmtpServer and delivers a raw RFC 5322 message to to
+func (m *MatterMail) SendMail(to string, rawMessage []byte) error {
+	client, err := m.dialSMTP()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if len(m.cfg.SmtpUser) > 0 {
+		auth := smtp.PlainAuth("", m.cfg.SmtpUser, m.cfg.SmtpPass, strings.Split(m.cfg.SmtpServer, ":")[0])
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(m.cfg.Email); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(rawMessage); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+//composeReply builds a plain text reply threaded to inReplyTo via the
+//In-Reply-To and References headers
+func composeReply(from, to, subject, inReplyTo, body string) []byte {
+	if !strings.HasPrefix(strings.ToLower(subject), "re:") {
+		subject = "Re: " + subject
+	}
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", to)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	if len(inReplyTo) > 0 {
+		fmt.Fprintf(&buf, "In-Reply-To: %s\r\n", inReplyTo)
+		fmt.Fprintf(&buf, "References: %s\r\n", inReplyTo)
+	}
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(body)
+
+	return []byte(buf.String())
+}
+
+//ServeOutgoingWebhook handles a Mattermost outgoing webhook / slash command
+//POST and delivers the typed text as a threaded reply to the last mail
+//posted in that channel
+func (m *MatterMail) ServeOutgoingWebhook(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	if len(m.cfg.WebhookToken) == 0 || r.FormValue("token") != m.cfg.WebhookToken {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	channelID := r.FormValue("channel_id")
+	text := strings.TrimSpace(r.FormValue("text"))
+	if len(text) == 0 {
+		return
+	}
+
+	thread, found := m.lastThread(channelID)
+	if !found {
+		m.logE.Println("No mail to reply to in channel", channelID)
+		return
+	}
+
+	recipient, err := mail.ParseAddress(thread.From)
+	if err != nil {
+		m.logE.Println("Error parsing reply recipient:", thread.From, err)
+		http.Error(w, "invalid recipient", http.StatusInternalServerError)
+		return
+	}
+
+	reply := composeReply(m.cfg.Email, thread.From, thread.Subject, thread.MessageID, text)
+	if err := m.SendMail(recipient.Address, reply); err != nil {
+		m.logE.Println("Error sending reply:", err)
+		http.Error(w, "error sending mail", http.StatusInternalServerError)
+		return
+	}
+}
+
+//startWebhookServer listens on cfg.ListenAddr for outgoing webhook requests
+func (m *MatterMail) startWebhookServer() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/reply", m.ServeOutgoingWebhook)
+
+	m.logI.Println("Listening for outgoing webhooks on", m.cfg.ListenAddr)
+	if err := http.ListenAndServe(m.cfg.ListenAddr, mux); err != nil {
+		m.logE.Println("Webhook server error:", err)
+	}
+}
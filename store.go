@@ -0,0 +1,29 @@
+package main
+
+//Store abstracts the operations MatterMail needs from wherever mail comes
+//from: IMAP, a local Maildir or a spool directory fed by procmail/fetchmail
+type Store interface {
+	//CheckNewMails looks for unread mail matching the configured rules and
+	//posts each match to Mattermost, marking it seen once posted
+	CheckNewMails() error
+
+	//IdleMailBox blocks until new mail might be available, returning nil so
+	//the caller can call CheckNewMails again
+	IdleMailBox() error
+
+	//Close releases any resource held by the store (connections, watchers)
+	Close() error
+}
+
+//newStore picks a Store implementation from cfg.Store, defaulting to IMAP
+//for backward compatibility with configs that predate this option
+func newStore(m *MatterMail) Store {
+	switch m.cfg.Store {
+	case "maildir":
+		return newMaildirStore(m)
+	case "spool":
+		return newSpoolStore(m)
+	default:
+		return newImapStore(m)
+	}
+}
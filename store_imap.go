@@ -0,0 +1,359 @@
+package main
+
+import (
+	"crypto/tls"
+	"github.com/emersion/go-imap"
+	idle "github.com/emersion/go-imap-idle"
+	"github.com/emersion/go-imap/client"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+//imapStore is the default Store, watching a live IMAP account
+type imapStore struct {
+	m      *MatterMail
+	client *client.Client
+}
+
+func newImapStore(m *MatterMail) *imapStore {
+	return &imapStore{m: m}
+}
+
+func (s *imapStore) Close() error {
+	if s.client == nil {
+		return nil
+	}
+	return s.client.Logout()
+}
+
+//imapAddr strips the imap(s):// scheme from cfg.ImapServer
+func imapAddr(server string) string {
+	server = strings.TrimPrefix(server, "imaps://")
+	return strings.TrimPrefix(server, "imap://")
+}
+
+//imapHost returns the host part of cfg.ImapServer, used as the TLS SNI/verify name
+func imapHost(server string) string {
+	host, _, err := net.SplitHostPort(imapAddr(server))
+	if err != nil {
+		return imapAddr(server)
+	}
+	return host
+}
+
+//dialImapClient opens and authenticates a fresh IMAP connection, independent
+//of s.client, so callers that need their own connection (e.g. one IDLE per
+//mailbox) don't fight over a single client
+func (s *imapStore) dialImapClient() (*client.Client, error) {
+	cfg := s.m.cfg
+	tlsConfig := &tls.Config{ServerName: imapHost(cfg.ImapServer), InsecureSkipVerify: cfg.TLSSkipVerify}
+
+	var c *client.Client
+	var err error
+
+	if strings.HasPrefix(cfg.ImapServer, "imaps://") {
+		c, err = client.DialTLS(imapAddr(cfg.ImapServer), tlsConfig)
+	} else {
+		c, err = client.Dial(imapAddr(cfg.ImapServer))
+		if err == nil {
+			if ok, _ := c.SupportStartTLS(); ok {
+				err = c.StartTLS(tlsConfig)
+			}
+		}
+	}
+
+	if err != nil {
+		s.m.logE.Println("Unable to connect:", err)
+		return nil, err
+	}
+
+	s.m.logI.Printf("Connected with %q\n", cfg.ImapServer)
+
+	if len(cfg.OAuth2Token) > 0 {
+		err = c.Authenticate(newXoauth2Client(cfg.Email, cfg.OAuth2Token))
+	} else {
+		err = c.Login(cfg.Email, cfg.EmailPass)
+	}
+
+	if err != nil {
+		s.m.logE.Println("Unable to login:", cfg.Email)
+		c.Logout()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (s *imapStore) checkConnection() error {
+	if s.client != nil && (s.client.State() == imap.AuthenticatedState || s.client.State() == imap.SelectedState) {
+		return nil
+	}
+
+	c, err := s.dialImapClient()
+	if err != nil {
+		return err
+	}
+
+	s.client = c
+	return nil
+}
+
+//Quarantine moves uid out of the currently selected mailbox into folder,
+//mirroring the IMAP MOVE command with COPY+STORE \Deleted+EXPUNGE since not
+//every server advertises the MOVE extension
+func (s *imapStore) Quarantine(uid uint32, folder string) error {
+	if err := s.checkConnection(); err != nil {
+		return err
+	}
+
+	seq := new(imap.SeqSet)
+	seq.AddNum(uid)
+
+	if err := s.client.UidCopy(seq, folder); err != nil {
+		return err
+	}
+
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	if err := s.client.UidStore(seq, item, []interface{}{imap.DeletedFlag}, nil); err != nil {
+		return err
+	}
+
+	return s.client.Expunge(nil)
+}
+
+//CheckNewMails looks for unread mail in every rule's mailbox and posts it to
+//its channel
+func (s *imapStore) CheckNewMails() error {
+	if err := s.checkConnection(); err != nil {
+		return err
+	}
+
+	for _, rule := range s.m.rules() {
+		mailboxes, err := s.expandMailboxes(rule.Mailbox)
+		if err != nil {
+			s.m.logE.Println("List:", err)
+			return err
+		}
+
+		for _, mailbox := range mailboxes {
+			if err := s.checkMailbox(s.client, mailbox, rule); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+//checkMailbox selects mailbox on c, searches it with rule's criteria and
+//posts every match to rule.Channel
+func (s *imapStore) checkMailbox(c *client.Client, mailbox string, rule Rule) error {
+	if _, err := c.Select(mailbox, false); err != nil {
+		return err
+	}
+
+	uids, err := c.UidSearch(rule.imapCriteria())
+	if err != nil {
+		s.m.logE.Println("UidSearch:", err)
+		return err
+	}
+
+	// no new messages
+	if len(uids) == 0 {
+		return nil
+	}
+
+	seq := new(imap.SeqSet)
+	seq.AddNum(uids...)
+
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seq, []imap.FetchItem{imap.FetchUid, imap.FetchRFC822}, messages)
+	}()
+
+	for imsg := range messages {
+		body := imsg.GetBody(&imap.BodySectionName{})
+		if body == nil {
+			continue
+		}
+		if err := s.m.PostMail(imsg.Uid, body, rule.Channel, rule.MessageTemplate); err != nil {
+			return err
+		}
+	}
+
+	if err := <-done; err != nil {
+		s.m.logE.Println("Fetch error:", err)
+		return err
+	}
+
+	//Mark all messages seen
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	if err := c.UidStore(seq, item, []interface{}{imap.SeenFlag}, nil); err != nil {
+		s.m.logE.Println("Error UidStore \\Seen:", err)
+		return err
+	}
+	return nil
+}
+
+//noMailboxPollInterval is how long IdleMailBox waits before returning when
+//no rule's Mailbox pattern currently expands to anything, so the caller's
+//check/idle loop doesn't spin
+const noMailboxPollInterval = time.Minute
+
+//IdleMailBox watches every configured mailbox, one goroutine per mailbox,
+//each on its own connection, re-issuing IDLE every 29 minutes as required by
+//RFC 2177 and waking up on EXISTS/EXPUNGE mailbox updates. It returns as
+//soon as any one watcher reports, after stopping and waiting for the rest
+//so no goroutine or connection is left running.
+func (s *imapStore) IdleMailBox() error {
+	mailboxes, err := s.allMailboxes()
+	if err != nil {
+		return err
+	}
+
+	if len(mailboxes) == 0 {
+		time.Sleep(noMailboxPollInterval)
+		return nil
+	}
+
+	cancel := make(chan struct{})
+	notify := make(chan error, len(mailboxes))
+	done := make(chan struct{}, len(mailboxes))
+
+	for _, mailbox := range mailboxes {
+		go s.idleMailbox(mailbox, cancel, notify, done)
+	}
+
+	err = <-notify
+	close(cancel)
+	for i := 0; i < len(mailboxes); i++ {
+		<-done
+	}
+
+	return err
+}
+
+//idleMailbox opens its own IMAP connection to watch a single mailbox. It
+//reports on notify as soon as it sees an update or an error, and on cancel
+//stops idling and signals done so IdleMailBox can wait for every watcher to
+//actually finish before returning.
+func (s *imapStore) idleMailbox(mailbox string, cancel <-chan struct{}, notify chan<- error, done chan<- struct{}) {
+	defer func() { done <- struct{}{} }()
+
+	c, err := s.dialImapClient()
+	if err != nil {
+		notify <- err
+		return
+	}
+	defer c.Logout()
+
+	if _, err := c.Select(mailbox, false); err != nil {
+		notify <- err
+		return
+	}
+
+	updates := make(chan client.Update, 1)
+	c.Updates = updates
+
+	idleClient := idle.NewClient(c)
+
+	stop := make(chan struct{})
+	idleDone := make(chan error, 1)
+	go func() {
+		idleDone <- idleClient.IdleWithFallback(stop, 29*time.Minute)
+	}()
+
+	select {
+	case <-updates:
+		close(stop)
+		<-idleDone
+		notify <- nil
+	case err := <-idleDone:
+		notify <- err
+	case <-cancel:
+		close(stop)
+		<-idleDone
+	}
+}
+
+//allMailboxes expands every rule's Mailbox pattern and returns the
+//deduplicated set of mailboxes that need to be watched
+func (s *imapStore) allMailboxes() ([]string, error) {
+	seen := make(map[string]bool)
+	var all []string
+
+	for _, rule := range s.m.rules() {
+		mailboxes, err := s.expandMailboxes(rule.Mailbox)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, mailbox := range mailboxes {
+			if !seen[mailbox] {
+				seen[mailbox] = true
+				all = append(all, mailbox)
+			}
+		}
+	}
+
+	return all, nil
+}
+
+//expandMailboxes runs a LIST command when pattern contains the IMAP
+//wildcards * or %, otherwise it returns pattern unchanged
+func (s *imapStore) expandMailboxes(pattern string) ([]string, error) {
+	if !strings.ContainsAny(pattern, "*%") {
+		return []string{pattern}, nil
+	}
+
+	mailboxes := make(chan *imap.MailboxInfo, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.client.List("", pattern, mailboxes)
+	}()
+
+	var names []string
+	for info := range mailboxes {
+		names = append(names, info.Name)
+	}
+
+	if err := <-done; err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
+
+//imapCriteria converts a Rule's SearchCriteria into an *imap.SearchCriteria,
+//always excluding messages already marked \Seen
+func (r Rule) imapCriteria() *imap.SearchCriteria {
+	c := imap.NewSearchCriteria()
+	c.WithoutFlags = []string{imap.SeenFlag}
+	c.Header = make(textproto.MIMEHeader)
+
+	sc := r.SearchCriteria
+
+	if len(sc.From) > 0 {
+		c.Header.Add("From", sc.From)
+	}
+	if len(sc.To) > 0 {
+		c.Header.Add("To", sc.To)
+	}
+	if len(sc.Subject) > 0 {
+		c.Header.Add("Subject", sc.Subject)
+	}
+
+	c.WithFlags = append(c.WithFlags, sc.HasFlag...)
+	c.WithoutFlags = append(c.WithoutFlags, sc.NotFlag...)
+
+	if len(sc.SentSince) > 0 {
+		if t, err := time.Parse("2006-01-02", sc.SentSince); err == nil {
+			c.SentSince = t
+		}
+	}
+
+	return c
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"github.com/emersion/go-maildir"
+	"github.com/fsnotify/fsnotify"
+	"hash/fnv"
+	"io/ioutil"
+	"net/mail"
+	"path/filepath"
+	"strings"
+)
+
+//maildirStore watches one or more Maildir folders below cfg.MaildirPath,
+//one per rule, mirroring aerc's worker/maildir backend
+type maildirStore struct {
+	m *MatterMail
+}
+
+func newMaildirStore(m *MatterMail) *maildirStore {
+	return &maildirStore{m: m}
+}
+
+func (s *maildirStore) Close() error {
+	return nil
+}
+
+//dir resolves a rule's Mailbox to a Maildir rooted at cfg.MaildirPath
+func (s *maildirStore) dir(rule Rule) maildir.Dir {
+	return maildir.Dir(filepath.Join(s.m.cfg.MaildirPath, rule.Mailbox))
+}
+
+//uidFromKey derives a stable pseudo-UID from a Maildir key so it can be used
+//for thread tracking the same way an IMAP UID is
+func uidFromKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+//CheckNewMails moves unseen messages from new/ to cur/ and posts the ones
+//matching each rule's header criteria (see SearchCriteria.matches)
+func (s *maildirStore) CheckNewMails() error {
+	for _, rule := range s.m.rules() {
+		dir := s.dir(rule)
+
+		msgs, err := dir.Unseen()
+		if err != nil {
+			s.m.logE.Println("Maildir Unseen:", err)
+			return err
+		}
+
+		for _, msg := range msgs {
+			r, err := msg.Open()
+			if err != nil {
+				s.m.logE.Println("Maildir Open:", err)
+				continue
+			}
+
+			data, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				s.m.logE.Println("Maildir read:", err)
+				continue
+			}
+
+			parsed, err := mail.ReadMessage(bytes.NewReader(data))
+			if err != nil {
+				s.m.logE.Println("Maildir parse:", err)
+				continue
+			}
+
+			if !rule.SearchCriteria.matches(parsed.Header) {
+				continue
+			}
+
+			if err := s.m.PostMail(uidFromKey(msg.Key()), bytes.NewReader(data), rule.Channel, rule.MessageTemplate); err != nil {
+				return err
+			}
+
+			if err := msg.SetFlags([]maildir.Flag{maildir.FlagSeen}); err != nil {
+				s.m.logE.Println("Maildir SetFlags:", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+//IdleMailBox watches every rule's new/ subdirectory for newly delivered mail
+func (s *maildirStore) IdleMailBox() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	for _, rule := range s.m.rules() {
+		newDir := filepath.Join(string(s.dir(rule)), "new")
+		if err := watcher.Add(newDir); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case event := <-watcher.Events:
+			if event.Op&(fsnotify.Create|fsnotify.Rename) != 0 {
+				return nil
+			}
+		case err := <-watcher.Errors:
+			return err
+		}
+	}
+}
+
+//matches reports whether header satisfies a substring match on every
+//configured header field (Maildir has no server-side SEARCH to delegate to).
+//Only From, To and Subject are checked; HasFlag, NotFlag and SentSince are
+//ignored.
+func (sc SearchCriteria) matches(header mail.Header) bool {
+	if len(sc.From) > 0 && !strings.Contains(header.Get("From"), sc.From) {
+		return false
+	}
+	if len(sc.To) > 0 && !strings.Contains(header.Get("To"), sc.To) {
+		return false
+	}
+	if len(sc.Subject) > 0 && !strings.Contains(header.Get("Subject"), sc.Subject) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"github.com/fsnotify/fsnotify"
+	"hash/fnv"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+)
+
+//spoolProcessedDir holds files already posted, so a restart doesn't repost them
+const spoolProcessedDir = "processed"
+
+//spoolStore watches a plain directory that procmail/fetchmail/LMTP delivers
+//individual .eml files into, one directory per rule
+type spoolStore struct {
+	m *MatterMail
+}
+
+func newSpoolStore(m *MatterMail) *spoolStore {
+	return &spoolStore{m: m}
+}
+
+func (s *spoolStore) Close() error {
+	return nil
+}
+
+//dir resolves a rule's Mailbox to a spool directory rooted at cfg.SpoolPath
+func (s *spoolStore) dir(rule Rule) string {
+	return filepath.Join(s.m.cfg.SpoolPath, rule.Mailbox)
+}
+
+//CheckNewMails reads every file sitting in each rule's spool directory,
+//posts the ones matching its header criteria (see SearchCriteria.matches),
+//and moves them into processed/
+func (s *spoolStore) CheckNewMails() error {
+	for _, rule := range s.m.rules() {
+		dir := s.dir(rule)
+
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			s.m.logE.Println("Spool ReadDir:", err)
+			return err
+		}
+
+		if err := os.MkdirAll(filepath.Join(dir, spoolProcessedDir), 0700); err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+
+			path := filepath.Join(dir, entry.Name())
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				s.m.logE.Println("Spool read:", err)
+				continue
+			}
+
+			msg, err := mail.ReadMessage(bytes.NewReader(data))
+			if err != nil {
+				s.m.logE.Println("Spool parse:", err)
+				continue
+			}
+
+			if rule.SearchCriteria.matches(msg.Header) {
+				h := fnv.New32a()
+				h.Write([]byte(entry.Name()))
+
+				if err := s.m.PostMail(h.Sum32(), bytes.NewReader(data), rule.Channel, rule.MessageTemplate); err != nil {
+					return err
+				}
+			}
+
+			if err := os.Rename(path, filepath.Join(dir, spoolProcessedDir, entry.Name())); err != nil {
+				s.m.logE.Println("Spool move:", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+//IdleMailBox watches every rule's spool directory for newly dropped files
+func (s *spoolStore) IdleMailBox() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	for _, rule := range s.m.rules() {
+		if err := watcher.Add(s.dir(rule)); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case event := <-watcher.Events:
+			if event.Op&(fsnotify.Create|fsnotify.Rename) != 0 {
+				return nil
+			}
+		case err := <-watcher.Errors:
+			return err
+		}
+	}
+}